@@ -0,0 +1,234 @@
+package mesh
+
+import(
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"sync"
+	"time")
+
+import(
+	"github.com/skycoin/skycoin/src/cipher")
+
+const (
+	addrBookMaxPerBucket = 1024		// per-bucket eviction cap
+	addrBookMaxPerIPRange = 3		// cap on entries sharing a /24, so one subnet can't fill the book
+)
+
+// AddrBookEntry is one peer's persisted connect info, tendermint
+// addrbook-style: "new" entries have never been successfully
+// connected to, "tried" ones have.
+type AddrBookEntry struct {
+	PubKey cipher.PubKey
+	Comm UDPCommConfig
+	AddedAt time.Time
+}
+
+type addrBookFile struct {
+	New []AddrBookEntry
+	Tried []AddrBookEntry
+}
+
+// AddrBook persists known peers to disk across "new" and "tried"
+// buckets, evicting the oldest entry in a bucket once it's full and
+// refusing additions that would let a single /24 dominate the book.
+type AddrBook struct {
+	lock sync.Mutex
+	path string
+
+	newBucket map[cipher.PubKey]AddrBookEntry
+	triedBucket map[cipher.PubKey]AddrBookEntry
+}
+
+// NewAddrBook loads path if it exists and returns an AddrBook backed
+// by it; path is rewritten on every subsequent Save().
+func NewAddrBook(path string) *AddrBook {
+	book := &AddrBook{
+		path: path,
+		newBucket: make(map[cipher.PubKey]AddrBookEntry),
+		triedBucket: make(map[cipher.PubKey]AddrBookEntry),
+	}
+	book.load()
+	return book
+}
+
+func (self*AddrBook) load() {
+	data, err := ioutil.ReadFile(self.path)
+	if err != nil {
+		return
+	}
+	var file addrBookFile
+	if json.Unmarshal(data, &file) != nil {
+		return
+	}
+	for _, entry := range file.New {
+		self.newBucket[entry.PubKey] = entry
+	}
+	for _, entry := range file.Tried {
+		self.triedBucket[entry.PubKey] = entry
+	}
+}
+
+// Save persists the address book to its path as JSON.
+func (self*AddrBook) Save() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	file := addrBookFile{}
+	for _, entry := range self.newBucket {
+		file.New = append(file.New, entry)
+	}
+	for _, entry := range self.triedBucket {
+		file.Tried = append(file.Tried, entry)
+	}
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(self.path, data, 0600)
+}
+
+// ipRangeKey groups an address by /24 (or, for IPv6, its full address)
+// so AddNew can refuse to let one subnet dominate a bucket.
+func ipRangeKey(comm UDPCommConfig) string {
+	if len(comm.ExternalHosts) == 0 {
+		return ""
+	}
+	ip := comm.ExternalHosts[0].IP.To4()
+	if ip == nil {
+		return comm.ExternalHosts[0].IP.String()
+	}
+	return fmt.Sprintf("%d.%d.%d.0/24", ip[0], ip[1], ip[2])
+}
+
+func (self*AddrBook) countInRange(bucket map[cipher.PubKey]AddrBookEntry, rangeKey string) int {
+	count := 0
+	for _, entry := range bucket {
+		if ipRangeKey(entry.Comm) == rangeKey {
+			count++
+		}
+	}
+	return count
+}
+
+func oldestKey(bucket map[cipher.PubKey]AddrBookEntry) (cipher.PubKey, bool) {
+	var oldestPubKey cipher.PubKey
+	var oldestAt time.Time
+	found := false
+	for pubKey, entry := range bucket {
+		if !found || entry.AddedAt.Before(oldestAt) {
+			oldestPubKey = pubKey
+			oldestAt = entry.AddedAt
+			found = true
+		}
+	}
+	return oldestPubKey, found
+}
+
+// AddNew records pubkey as a newly-learned peer, unless it's already
+// known, its /24 is already at the cap, or doing so requires evicting
+// and the bucket has no entries to evict.
+func (self*AddrBook) AddNew(pubKey cipher.PubKey, comm UDPCommConfig) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	if _, found := self.newBucket[pubKey]; found {
+		return false
+	}
+	if _, found := self.triedBucket[pubKey]; found {
+		return false
+	}
+
+	rangeKey := ipRangeKey(comm)
+	if rangeKey != "" {
+		inRange := self.countInRange(self.newBucket, rangeKey) + self.countInRange(self.triedBucket, rangeKey)
+		if inRange >= addrBookMaxPerIPRange {
+			return false
+		}
+	}
+
+	if len(self.newBucket) >= addrBookMaxPerBucket {
+		evict, found := oldestKey(self.newBucket)
+		if !found {
+			return false
+		}
+		delete(self.newBucket, evict)
+	}
+
+	self.newBucket[pubKey] = AddrBookEntry{pubKey, comm, time.Now()}
+	return true
+}
+
+// MarkTried moves pubkey from the "new" bucket into "tried", evicting
+// the oldest tried entry first if that bucket is full.
+func (self*AddrBook) MarkTried(pubKey cipher.PubKey) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	entry, found := self.newBucket[pubKey]
+	if !found {
+		entry, found = self.triedBucket[pubKey]
+		if !found {
+			return
+		}
+	}
+	delete(self.newBucket, pubKey)
+
+	if len(self.triedBucket) >= addrBookMaxPerBucket {
+		evict, evictFound := oldestKey(self.triedBucket)
+		if evictFound {
+			delete(self.triedBucket, evict)
+		}
+	}
+	entry.AddedAt = time.Now()
+	self.triedBucket[pubKey] = entry
+}
+
+func (self*AddrBook) Known(pubKey cipher.PubKey) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	_, newFound := self.newBucket[pubKey]
+	_, triedFound := self.triedBucket[pubKey]
+	return newFound || triedFound
+}
+
+// Sample returns up to n entries drawn from both buckets, for
+// answering a PEX request (pexMsgRequest).
+func (self*AddrBook) Sample(n int) []AddrBookEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	all := make([]AddrBookEntry, 0, len(self.newBucket)+len(self.triedBucket))
+	for _, entry := range self.newBucket {
+		all = append(all, entry)
+	}
+	for _, entry := range self.triedBucket {
+		all = append(all, entry)
+	}
+
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
+
+// SampleUntried returns up to n entries from the "new" bucket only,
+// for the PEX reactor's auto-connect loop.
+func (self*AddrBook) SampleUntried(n int) []AddrBookEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	all := make([]AddrBookEntry, 0, len(self.newBucket))
+	for _, entry := range self.newBucket {
+		all = append(all, entry)
+	}
+
+	rand.Shuffle(len(all), func(i, j int) { all[i], all[j] = all[j], all[i] })
+	if len(all) > n {
+		all = all[:n]
+	}
+	return all
+}
@@ -0,0 +1,68 @@
+package mesh
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func commFor(ip string) UDPCommConfig {
+	return UDPCommConfig{
+		DatagramLength: 512,
+		ExternalHosts:  []net.UDPAddr{{IP: net.ParseIP(ip), Port: 30000}},
+	}
+}
+
+func TestAddrBookAddNewAndSample(t *testing.T) {
+	book := NewAddrBook(filepath.Join(t.TempDir(), "addrbook.json"))
+
+	pub, _ := cipher.GenerateKeyPair()
+	if !book.AddNew(pub, commFor("10.0.0.1")) {
+		t.Fatal("AddNew should accept a fresh entry")
+	}
+	if book.AddNew(pub, commFor("10.0.0.1")) {
+		t.Fatal("AddNew should refuse a duplicate pubkey")
+	}
+	if !book.Known(pub) {
+		t.Fatal("Known should report the entry just added")
+	}
+
+	sample := book.Sample(10)
+	if len(sample) != 1 || sample[0].PubKey != pub {
+		t.Fatalf("Sample = %v, want one entry for %v", sample, pub)
+	}
+}
+
+func TestAddrBookIPRangeCap(t *testing.T) {
+	book := NewAddrBook(filepath.Join(t.TempDir(), "addrbook.json"))
+
+	for i := 0; i < addrBookMaxPerIPRange; i++ {
+		pub, _ := cipher.GenerateKeyPair()
+		ip := net.IPv4(10, 0, 0, byte(i+1)).String()
+		if !book.AddNew(pub, commFor(ip)) {
+			t.Fatalf("AddNew #%d in range should succeed", i)
+		}
+	}
+
+	pub, _ := cipher.GenerateKeyPair()
+	if book.AddNew(pub, commFor("10.0.0.250")) {
+		t.Fatal("AddNew should refuse once a /24 is at its cap")
+	}
+}
+
+func TestAddrBookMarkTriedMovesEntry(t *testing.T) {
+	book := NewAddrBook(filepath.Join(t.TempDir(), "addrbook.json"))
+
+	pub, _ := cipher.GenerateKeyPair()
+	book.AddNew(pub, commFor("10.0.0.1"))
+	book.MarkTried(pub)
+
+	if _, found := book.newBucket[pub]; found {
+		t.Fatal("MarkTried should remove the entry from the new bucket")
+	}
+	if _, found := book.triedBucket[pub]; !found {
+		t.Fatal("MarkTried should add the entry to the tried bucket")
+	}
+}
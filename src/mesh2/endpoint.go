@@ -0,0 +1,74 @@
+package mesh
+
+import(
+	"net"
+	"sync")
+
+// Endpoint is modeled on WireGuard's Bind/Endpoint split: it remembers
+// the peer's last-known destination address (dst) and which local
+// listen socket last received a valid datagram from the peer (src), so
+// sendMessage can reuse a known-good path instead of picking randomly.
+type Endpoint interface {
+	Dst() (net.UDPAddr, bool)
+	SetDst(addr net.UDPAddr)
+	Src() (portIndex int, ok bool)
+	SetSrc(portIndex int)
+	ClearSrc()
+}
+
+type udpEndpoint struct {
+	lock sync.Mutex
+
+	hasDst bool
+	dst net.UDPAddr
+
+	hasSrc bool
+	srcPortIndex int
+}
+
+func newUDPEndpoint() *udpEndpoint {
+	return &udpEndpoint{}
+}
+
+func (self*udpEndpoint) Dst() (net.UDPAddr, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.dst, self.hasDst
+}
+
+// SetDst records a new active destination for the peer, e.g. after a
+// roaming datagram arrives from a previously-unseen address.
+func (self*udpEndpoint) SetDst(addr net.UDPAddr) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.dst = addr
+	self.hasDst = true
+}
+
+func (self*udpEndpoint) Src() (int, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return self.srcPortIndex, self.hasSrc
+}
+
+func (self*udpEndpoint) SetSrc(portIndex int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.srcPortIndex = portIndex
+	self.hasSrc = true
+}
+
+// ClearSrc drops the cached source socket, forcing sendMessage to
+// reselect one (e.g. after a network change invalidates the cache).
+func (self*udpEndpoint) ClearSrc() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.hasSrc = false
+}
+
+// peerConnection pairs a peer's advertised connect info with the
+// Endpoint tracking where it was last reached.
+type peerConnection struct {
+	comm UDPCommConfig
+	endpoint Endpoint
+}
@@ -0,0 +1,322 @@
+package mesh
+
+import(
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time")
+
+import(
+	"github.com/skycoin/encoder"
+	"github.com/skycoin/skycoin/src/cipher")
+
+const (
+	fragmentPayloadSize = 1200		// MTU-safe default: survives typical PMTU
+	fragmentReassemblyLRUSize = 64		// bounded in-flight message IDs per peer
+	fragmentReassemblyTimeout = 10 * time.Second
+	framedDefaultMaxMessageSize = 16 * 1024 * 1024
+	fragmentSweepInterval = time.Second
+)
+
+// fragmentFrame is the wire format FramedUDPTransport splits an
+// oversized TransportMessage's Contents into. MsgID scopes FragIdx
+// across the fragments of one message; the peer it came from (and so
+// which reassembly buffer it belongs to) is carried by the outer
+// TransportMessage.SrcPeer the inner transport already delivers.
+type fragmentFrame struct {
+	MsgID uint32
+	FragIdx uint16
+	FragCount uint16
+	Payload []byte
+}
+
+type partialMessage struct {
+	fragCount uint16
+	received map[uint16][]byte
+	firstSeen time.Time
+}
+
+// peerReassembly holds the fragments in flight for one peer, bounded
+// by an LRU of message IDs so a peer can't exhaust memory by opening
+// unboundedly many partial messages.
+type peerReassembly struct {
+	lock sync.Mutex
+	order []uint32
+	partials map[uint32]*partialMessage
+}
+
+func newPeerReassembly() *peerReassembly {
+	return &peerReassembly{
+		partials: make(map[uint32]*partialMessage),
+	}
+}
+
+func (self*peerReassembly) evictOldestIfFull() {
+	if len(self.order) < fragmentReassemblyLRUSize {
+		return
+	}
+	oldest := self.order[0]
+	self.order = self.order[1:]
+	delete(self.partials, oldest)
+}
+
+// addFragment returns the reassembled message once every fragment of
+// msgID has arrived, or (nil, false) while it's still incomplete.
+func (self*peerReassembly) addFragment(frame fragmentFrame) ([]byte, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	partial, found := self.partials[frame.MsgID]
+	if !found {
+		self.evictOldestIfFull()
+		partial = &partialMessage{frame.FragCount, make(map[uint16][]byte), time.Now()}
+		self.partials[frame.MsgID] = partial
+		self.order = append(self.order, frame.MsgID)
+	} else {
+		// Mark msgID most recently used so eviction takes the least
+		// recently used partial first.
+		for i, id := range self.order {
+			if id == frame.MsgID {
+				self.order = append(append(self.order[:i], self.order[i+1:]...), id)
+				break
+			}
+		}
+	}
+	partial.received[frame.FragIdx] = frame.Payload
+
+	if uint16(len(partial.received)) < partial.fragCount {
+		return nil, false
+	}
+
+	whole := make([]byte, 0, int(partial.fragCount)*fragmentPayloadSize)
+	for i := uint16(0); i < partial.fragCount; i++ {
+		whole = append(whole, partial.received[i]...)
+	}
+
+	delete(self.partials, frame.MsgID)
+	for i, id := range self.order {
+		if id == frame.MsgID {
+			self.order = append(self.order[:i], self.order[i+1:]...)
+			break
+		}
+	}
+
+	return whole, true
+}
+
+func (self*peerReassembly) discardStale(olderThan time.Time) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+
+	for i := 0; i < len(self.order); {
+		id := self.order[i]
+		if self.partials[id].firstSeen.Before(olderThan) {
+			delete(self.partials, id)
+			self.order = append(self.order[:i], self.order[i+1:]...)
+			continue
+		}
+		i++
+	}
+}
+
+// FramedUDPTransport lifts the inner transport's fixed datagram size
+// cap by splitting oversized messages into numbered fragments and
+// reassembling them on receipt. Callers that don't need this should
+// keep using the inner transport directly, since framing adds a
+// round of allocation and reassembly latency.
+type FramedUDPTransport struct {
+	inner Transport
+	maxMessageSize uint
+
+	nextMsgID uint32
+
+	lock *sync.Mutex
+	peers map[cipher.PubKey]*peerReassembly
+
+	messagesReceived chan TransportMessage
+	closing chan bool
+	closeWait *sync.WaitGroup
+}
+
+// NewFramedUDPTransport opens a UDPTransport and layers fragmentation
+// and reassembly on top of it.
+func NewFramedUDPTransport(config UDPConfig) (*FramedUDPTransport, error) {
+	inner, err := NewUDPTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	maxMessageSize := uint(config.MaxFramedMessageSize)
+	if maxMessageSize == 0 {
+		maxMessageSize = framedDefaultMaxMessageSize
+	}
+
+	ret := &FramedUDPTransport{
+		inner,
+		maxMessageSize,
+		0,
+		&sync.Mutex{},
+		make(map[cipher.PubKey]*peerReassembly),
+		make(chan TransportMessage, config.ReceiveChannelLength),
+		make(chan bool, 2),
+		&sync.WaitGroup{},
+	}
+
+	ret.closeWait.Add(2)
+	go ret.receiveLoop()
+	go ret.sweepLoop()
+
+	return ret, nil
+}
+
+func (self*FramedUDPTransport) safeGetPeer(peer cipher.PubKey) (*peerReassembly, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	reassembly, found := self.peers[peer]
+	return reassembly, found
+}
+
+func (self*FramedUDPTransport) ConnectToPeer(peer cipher.PubKey, connectInfo string) error {
+	err := self.inner.ConnectToPeer(peer, connectInfo)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.peers[peer] = newPeerReassembly()
+	return nil
+}
+
+func (self*FramedUDPTransport) DisconnectFromPeer(peer cipher.PubKey) {
+	self.inner.DisconnectFromPeer(peer)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.peers, peer)
+}
+
+func (self*FramedUDPTransport) ConnectedToPeer(peer cipher.PubKey) bool {
+	return self.inner.ConnectedToPeer(peer)
+}
+
+func (self*FramedUDPTransport) SetCrypto(crypto interface{}) {
+	self.inner.SetCrypto(crypto)
+}
+
+func (self*FramedUDPTransport) IsReliable() bool {
+	return self.inner.IsReliable()
+}
+
+func (self*FramedUDPTransport) RetransmitIntervalHint(toPeer cipher.PubKey) uint32 {
+	return self.inner.RetransmitIntervalHint(toPeer)
+}
+
+func (self*FramedUDPTransport) GetTransportConnectInfo() string {
+	return self.inner.GetTransportConnectInfo()
+}
+
+// GetMaximumMessageSizeToPeer reports the large, effectively-unbounded
+// cap fragmentation allows, rather than the inner transport's
+// per-datagram limit.
+func (self*FramedUDPTransport) GetMaximumMessageSizeToPeer(peer cipher.PubKey) uint {
+	return self.maxMessageSize
+}
+
+func chunkPayload(payload []byte) [][]byte {
+	if len(payload) == 0 {
+		return [][]byte{[]byte{}}
+	}
+	chunks := make([][]byte, 0, (len(payload)/fragmentPayloadSize)+1)
+	for start := 0; start < len(payload); start += fragmentPayloadSize {
+		end := start + fragmentPayloadSize
+		if end > len(payload) {
+			end = len(payload)
+		}
+		chunks = append(chunks, payload[start:end])
+	}
+	return chunks
+}
+
+func (self*FramedUDPTransport) SendMessage(msg TransportMessage) error {
+	chunks := chunkPayload(msg.Contents)
+	msgID := atomic.AddUint32(&self.nextMsgID, 1)
+
+	for idx, chunk := range chunks {
+		frame := fragmentFrame{msgID, uint16(idx), uint16(len(chunks)), chunk}
+		framed := TransportMessage{DestPeer: msg.DestPeer, Contents: encoder.Serialize(frame)}
+		err := self.inner.SendMessage(framed)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (self*FramedUDPTransport) handleFrame(raw TransportMessage) {
+	var v reflect.Value = reflect.New(reflect.TypeOf(fragmentFrame{}))
+	_, err := encoder.DeserializeRawToValue(raw.Contents, v)
+	if err != nil {
+		return
+	}
+	frame := (v.Elem().Interface()).(fragmentFrame)
+
+	reassembly, found := self.safeGetPeer(raw.SrcPeer)
+	if !found {
+		return
+	}
+
+	whole, complete := reassembly.addFragment(frame)
+	if !complete {
+		return
+	}
+
+	self.messagesReceived <- TransportMessage{DestPeer: raw.DestPeer, SrcPeer: raw.SrcPeer, Contents: whole}
+}
+
+func (self*FramedUDPTransport) receiveLoop() {
+	defer self.closeWait.Done()
+	for {
+		select {
+			case raw := <- self.inner.GetReceiveChannel(): {
+				self.handleFrame(raw)
+			}
+			case <- self.closing:
+				return
+		}
+	}
+}
+
+func (self*FramedUDPTransport) sweepLoop() {
+	defer self.closeWait.Done()
+	ticker := time.NewTicker(fragmentSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <- ticker.C: {
+				cutoff := time.Now().Add(-fragmentReassemblyTimeout)
+				self.lock.Lock()
+				peers := make([]*peerReassembly, 0, len(self.peers))
+				for _, reassembly := range self.peers {
+					peers = append(peers, reassembly)
+				}
+				self.lock.Unlock()
+				for _, reassembly := range peers {
+					reassembly.discardStale(cutoff)
+				}
+			}
+			case <- self.closing:
+				return
+		}
+	}
+}
+
+func (self*FramedUDPTransport) GetReceiveChannel() chan TransportMessage {
+	return self.messagesReceived
+}
+
+func (self*FramedUDPTransport) Close() {
+	self.closing <- true
+	self.closing <- true
+	self.closeWait.Wait()
+	self.inner.Close()
+}
@@ -0,0 +1,44 @@
+package mesh
+
+import (
+	"testing"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// newLoopbackUDPConfigs builds a pair of UDPConfigs for two distinct,
+// real peers talking over 127.0.0.1, one per layer's loopback test
+// fixture (newLoopbackUDPPair, newLoopbackReliablePair,
+// newLoopbackFramedPair, newLoopbackSecretPair) so the connection
+// boilerplate -- identities, addresses, ports -- lives in one place.
+func newLoopbackUDPConfigs(basePort uint16, datagramLength uint16) (cfgA, cfgB UDPConfig, pubA, pubB cipher.PubKey, secA, secB cipher.SecKey) {
+	pubA, secA = cipher.GenerateKeyPair()
+	pubB, secB = cipher.GenerateKeyPair()
+
+	config := UDPConfig{
+		TransportConfig: TransportConfig{SendChannelLength: 8, ReceiveChannelLength: 8},
+		DatagramLength:  datagramLength,
+		LocalAddress:    "127.0.0.1",
+		NumListenPorts:  1,
+		ExternalAddress: "127.0.0.1",
+	}
+
+	cfgA = config
+	cfgA.TransportConfig.LocalPubKey = pubA
+	cfgA.ListenPortMin = basePort
+
+	cfgB = config
+	cfgB.TransportConfig.LocalPubKey = pubB
+	cfgB.ListenPortMin = basePort + 1
+
+	return
+}
+
+func connectLoopbackPeers(t *testing.T, a, b Transport, pubA, pubB cipher.PubKey) {
+	if err := a.ConnectToPeer(pubB, b.GetTransportConnectInfo()); err != nil {
+		t.Fatalf("A.ConnectToPeer(B): %v", err)
+	}
+	if err := b.ConnectToPeer(pubA, a.GetTransportConnectInfo()); err != nil {
+		t.Fatalf("B.ConnectToPeer(A): %v", err)
+	}
+}
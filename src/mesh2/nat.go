@@ -0,0 +1,272 @@
+package mesh
+
+import(
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time")
+
+import(
+	"github.com/ccding/go-stun/stun"
+	"github.com/huin/goupnp/dcps/internetgateway1"
+	"github.com/jackpal/gateway"
+	natpmp "github.com/jackpal/go-nat-pmp")
+
+// NATTraversal discovers the external address a locally-bound UDP
+// socket is reachable on. UPnP and NAT-PMP additionally install a port
+// mapping lease that must be refreshed and eventually released; STUN
+// just hole-punches and holds nothing.
+type NATTraversal interface {
+	Discover(conn *net.UDPConn, localPort uint16) (net.UDPAddr, error)
+	Release()
+}
+
+func newNATTraversal(method string, config UDPConfig) (NATTraversal, error) {
+	switch method {
+		case "stun":
+			return &stunTraversal{config: config}, nil
+		case "upnp":
+			return &upnpTraversal{config: config}, nil
+		case "natpmp":
+			return &natPMPTraversal{config: config}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("Unknown NAT traversal method: %v", method))
+}
+
+// discoverExternalAddr tries each method in config.NATMethods (STUN
+// only, if unset) in order and returns the first one that succeeds,
+// along with the NATTraversal that produced it so the caller can
+// Release() any lease it holds on Close().
+func discoverExternalAddr(config UDPConfig, conn *net.UDPConn, localPort uint16) (net.UDPAddr, NATTraversal, error) {
+	methods := config.NATMethods
+	if len(methods) == 0 {
+		methods = []string{"stun"}
+	}
+
+	for _, methodName := range methods {
+		method, err := newNATTraversal(methodName, config)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NAT traversal error: %v\n", err)
+			continue
+		}
+		addr, err := method.Discover(conn, localPort)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "NAT traversal method '%v' failed: %v\n", methodName, err)
+			continue
+		}
+		return addr, method, nil
+	}
+
+	return net.UDPAddr{}, nil, errors.New("All NAT traversal methods failed")
+}
+
+func defaultLeaseSeconds(config UDPConfig) uint32 {
+	if config.PortMapLeaseSeconds == 0 {
+		return 3600
+	}
+	return config.PortMapLeaseSeconds
+}
+
+// refreshInterval halves leaseSeconds to get a refresh period, clamped
+// to at least a second so a short lease (e.g. PortMapLeaseSeconds: 1)
+// can't round down to zero and panic time.NewTicker.
+func refreshInterval(leaseSeconds uint32) time.Duration {
+	interval := time.Duration(leaseSeconds/2) * time.Second
+	if interval < time.Second {
+		return time.Second
+	}
+	return interval
+}
+
+// stunTraversal hole-punches via config.StunEndpoints. It holds no
+// lease, so Release is a no-op.
+type stunTraversal struct {
+	config UDPConfig
+}
+
+func (self*stunTraversal) Discover(conn *net.UDPConn, localPort uint16) (net.UDPAddr, error) {
+	if len(self.config.StunEndpoints) == 0 {
+		return net.UDPAddr{}, errors.New("No STUN endpoints configured")
+	}
+
+	for _, addr := range self.config.StunEndpoints {
+		stunClient := stun.NewClientWithConnection(conn)
+		stunClient.SetServerAddr(addr)
+
+		_, host, err := stunClient.Discover()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "STUN Error for Endpoint '%v': %v\n", addr, err)
+			continue
+		}
+		externalHost, resolvErr := net.ResolveUDPAddr("udp", host.TransportAddr())
+		if resolvErr != nil {
+			return net.UDPAddr{}, resolvErr
+		}
+		return *externalHost, nil
+	}
+
+	return net.UDPAddr{}, errors.New("All STUN requests failed")
+}
+
+func (self*stunTraversal) Release() {
+}
+
+// upnpTraversal asks a UPnP IGD on the LAN to map localPort and keeps
+// the lease alive on a background goroutine until Release is called.
+type upnpTraversal struct {
+	config UDPConfig
+
+	lock sync.Mutex
+	client *internetgateway1.WANIPConnection1
+	localPort uint16
+	stopRefresh chan bool
+}
+
+func (self*upnpTraversal) Discover(conn *net.UDPConn, localPort uint16) (net.UDPAddr, error) {
+	clients, _, err := internetgateway1.NewWANIPConnection1Clients()
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+	if len(clients) == 0 {
+		return net.UDPAddr{}, errors.New("No UPnP IGD found")
+	}
+	client := clients[0]
+
+	externalIP, err := client.GetExternalIPAddress()
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+
+	leaseSeconds := defaultLeaseSeconds(self.config)
+	localIP, err := gateway.DiscoverInterface()
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+
+	addErr := client.AddPortMapping("", localPort, "UDP", localPort, localIP.String(), true, "skycoin-mesh", leaseSeconds)
+	if addErr != nil {
+		return net.UDPAddr{}, addErr
+	}
+
+	self.lock.Lock()
+	self.client = client
+	self.localPort = localPort
+	self.stopRefresh = make(chan bool, 1)
+	self.lock.Unlock()
+
+	go self.refreshLoop(leaseSeconds, localIP.String())
+
+	return net.UDPAddr{IP: net.ParseIP(externalIP), Port: int(localPort)}, nil
+}
+
+func (self*upnpTraversal) refreshLoop(leaseSeconds uint32, localIP string) {
+	ticker := time.NewTicker(refreshInterval(leaseSeconds))
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <- ticker.C: {
+				self.lock.Lock()
+				client, localPort := self.client, self.localPort
+				self.lock.Unlock()
+				err := client.AddPortMapping("", localPort, "UDP", localPort, localIP, true, "skycoin-mesh", leaseSeconds)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error refreshing UPnP port mapping: %v\n", err)
+				}
+			}
+			case <- self.stopRefresh:
+				return
+		}
+	}
+}
+
+func (self*upnpTraversal) Release() {
+	self.lock.Lock()
+	client, localPort, stopRefresh := self.client, self.localPort, self.stopRefresh
+	self.lock.Unlock()
+
+	if stopRefresh != nil {
+		stopRefresh <- true
+	}
+	if client != nil {
+		client.DeletePortMapping("", localPort, "UDP")
+	}
+}
+
+// natPMPTraversal is the NAT-PMP equivalent of upnpTraversal, used for
+// gateways (common on symmetric-NAT routers) that don't speak UPnP.
+type natPMPTraversal struct {
+	config UDPConfig
+
+	lock sync.Mutex
+	client *natpmp.Client
+	localPort uint16
+	stopRefresh chan bool
+}
+
+func (self*natPMPTraversal) Discover(conn *net.UDPConn, localPort uint16) (net.UDPAddr, error) {
+	gatewayIP, err := gateway.DiscoverGateway()
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+
+	client := natpmp.NewClient(gatewayIP)
+
+	externalAddr, err := client.GetExternalAddress()
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+
+	leaseSeconds := defaultLeaseSeconds(self.config)
+	mapping, err := client.AddPortMapping("udp", int(localPort), int(localPort), int(leaseSeconds))
+	if err != nil {
+		return net.UDPAddr{}, err
+	}
+
+	self.lock.Lock()
+	self.client = client
+	self.localPort = localPort
+	self.stopRefresh = make(chan bool, 1)
+	self.lock.Unlock()
+
+	go self.refreshLoop(leaseSeconds)
+
+	ip := externalAddr.ExternalIPAddress
+	return net.UDPAddr{IP: net.IPv4(ip[0], ip[1], ip[2], ip[3]), Port: int(mapping.MappedExternalPort)}, nil
+}
+
+func (self*natPMPTraversal) refreshLoop(leaseSeconds uint32) {
+	ticker := time.NewTicker(refreshInterval(leaseSeconds))
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <- ticker.C: {
+				self.lock.Lock()
+				client, localPort := self.client, self.localPort
+				self.lock.Unlock()
+				_, err := client.AddPortMapping("udp", int(localPort), int(localPort), int(leaseSeconds))
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error refreshing NAT-PMP port mapping: %v\n", err)
+				}
+			}
+			case <- self.stopRefresh:
+				return
+		}
+	}
+}
+
+func (self*natPMPTraversal) Release() {
+	self.lock.Lock()
+	client, localPort, stopRefresh := self.client, self.localPort, self.stopRefresh
+	self.lock.Unlock()
+
+	if stopRefresh != nil {
+		stopRefresh <- true
+	}
+	if client != nil {
+		client.AddPortMapping("udp", int(localPort), int(localPort), 0)
+	}
+}
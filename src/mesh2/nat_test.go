@@ -0,0 +1,73 @@
+package mesh
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDefaultLeaseSeconds(t *testing.T) {
+	if got := defaultLeaseSeconds(UDPConfig{}); got != 3600 {
+		t.Fatalf("default = %v, want 3600", got)
+	}
+	if got := defaultLeaseSeconds(UDPConfig{PortMapLeaseSeconds: 120}); got != 120 {
+		t.Fatalf("override = %v, want 120", got)
+	}
+}
+
+// TestRefreshIntervalClampsShortLeases covers the case defaultLeaseSeconds
+// doesn't: an operator-set PortMapLeaseSeconds of 1 survives that
+// validation (it's non-zero) but halves to a zero duration, which used
+// to panic time.NewTicker in refreshLoop. A lease of 2 is the smallest
+// that halves to exactly one second.
+func TestRefreshIntervalClampsShortLeases(t *testing.T) {
+	if got := refreshInterval(1); got != time.Second {
+		t.Fatalf("refreshInterval(1) = %v, want %v", got, time.Second)
+	}
+	if got := refreshInterval(2); got != time.Second {
+		t.Fatalf("refreshInterval(2) = %v, want %v", got, time.Second)
+	}
+	if got := refreshInterval(3600); got != 1800*time.Second {
+		t.Fatalf("refreshInterval(3600) = %v, want %v", got, 1800*time.Second)
+	}
+}
+
+// TestOpenUDPPortFixedPortSkipsNATTraversal checks the path that needs
+// no network access to exercise: when ListenPortMin is set, OpenUDPPort
+// must bind that exact port and report it as the external host without
+// going through any NATTraversal method.
+func TestOpenUDPPortFixedPortSkipsNATTraversal(t *testing.T) {
+	config := UDPConfig{
+		TransportConfig: TransportConfig{SendChannelLength: 1, ReceiveChannelLength: 1},
+		DatagramLength:  512,
+		LocalAddress:    "127.0.0.1",
+		ExternalAddress: "127.0.0.1",
+		ListenPortMin:   31200,
+	}
+
+	var wg sync.WaitGroup
+	errorChan := make(chan error, 1)
+	portChan := make(chan ListenPort, 1)
+
+	wg.Add(1)
+	OpenUDPPort(0, config, &wg, errorChan, portChan)
+	wg.Wait()
+
+	select {
+	case err := <-errorChan:
+		t.Fatalf("OpenUDPPort: %v", err)
+	default:
+	}
+
+	port := <-portChan
+	defer port.conn.Close()
+
+	if port.natTraversal != nil {
+		t.Fatal("fixed-port listen should not install a NAT traversal method")
+	}
+	want := net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 31200}
+	if port.externalHost.String() != want.String() {
+		t.Fatalf("externalHost = %v, want %v", port.externalHost, want)
+	}
+}
@@ -0,0 +1,213 @@
+package mesh
+
+import(
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"reflect"
+	"time")
+
+import(
+	"github.com/skycoin/encoder"
+	"github.com/skycoin/skycoin/src/cipher")
+
+const (
+	pexChanData byte = 0		// ordinary caller traffic, tag stripped before delivery
+	pexChanControl byte = 1	// PEX protocol traffic, handled internally
+
+	pexMsgRequest byte = 0
+	pexMsgAddrs byte = 1
+
+	pexInterval = 30 * time.Second
+	pexGossipCount = 8			// addresses offered per PexAddrs reply
+	pexAskPeerCount = 3			// connected peers asked for addresses per tick
+)
+
+// PexPeerInfo is what AddrBook entries become on the wire: the
+// bookkeeping fields (AddedAt, bucket) are local only.
+type PexPeerInfo struct {
+	PubKey cipher.PubKey
+	Comm UDPCommConfig
+}
+
+// PexAddrs is a node's reply to a PEX request (a pexMsgRequest control
+// message): a sample of the addresses in its address book.
+type PexAddrs struct {
+	Peers []PexPeerInfo
+}
+
+// pexState holds the configuration EnablePEX installed; its presence
+// on a UDPTransport (nil by default) turns on the channel-tagging in
+// SendMessage/receiveMessage that PEX control traffic needs.
+type pexState struct {
+	book *AddrBook
+	maxPeers int
+}
+
+// seedInfo is the format AddSeeds expects each string in: a peer's
+// pubkey plus its advertised connect info, bundled so the book has
+// enough to dial it without first exchanging anything.
+type seedInfo struct {
+	PubKey cipher.PubKey
+	Comm UDPCommConfig
+}
+
+// EnablePEX turns on peer exchange: UDPTransport will periodically ask
+// a few connected peers for more addresses, record what it learns in
+// book, and auto-connect to unseen ones up to UDPConfig.MaxPeers. The
+// book is written to disk only when its Save() is called.
+func (self*UDPTransport) EnablePEX(book *AddrBook) {
+	self.lock.Lock()
+	self.pex = &pexState{book, int(self.config.MaxPeers)}
+	self.lock.Unlock()
+
+	self.closeWait.Add(1)
+	go self.pexLoop()
+}
+
+// AddSeeds parses each string as a JSON-encoded seedInfo and records
+// it in the address book as a candidate to auto-connect to. Requires
+// EnablePEX to have been called first.
+func (self*UDPTransport) AddSeeds(seeds []string) {
+	self.lock.Lock()
+	pex := self.pex
+	self.lock.Unlock()
+
+	if pex == nil {
+		fmt.Fprintf(os.Stderr, "AddSeeds called before EnablePEX\n")
+		return
+	}
+
+	for _, seedStr := range seeds {
+		var seed seedInfo
+		err := json.Unmarshal([]byte(seedStr), &seed)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error parsing seed '%v': %v\n", seedStr, err)
+			continue
+		}
+		pex.book.AddNew(seed.PubKey, seed.Comm)
+	}
+}
+
+func (self*UDPTransport) connectedPeerKeys() []cipher.PubKey {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	keys := make([]cipher.PubKey, 0, len(self.connectedPeers))
+	for peer := range self.connectedPeers {
+		keys = append(keys, peer)
+	}
+	return keys
+}
+
+func (self*UDPTransport) sendPexControl(peer cipher.PubKey, body []byte) {
+	framed := TransportMessage{DestPeer: peer, SrcPeer: self.config.LocalPubKey, Contents: append([]byte{pexChanControl}, body...)}
+	self.messagesToSend <- framed
+}
+
+func (self*UDPTransport) sendPexRequest(peer cipher.PubKey) {
+	self.sendPexControl(peer, []byte{pexMsgRequest})
+}
+
+func (self*UDPTransport) sendPexAddrs(peer cipher.PubKey, book *AddrBook) {
+	sample := book.Sample(pexGossipCount)
+	peers := make([]PexPeerInfo, len(sample))
+	for i, entry := range sample {
+		peers[i] = PexPeerInfo{entry.PubKey, entry.Comm}
+	}
+	body := append([]byte{pexMsgAddrs}, encoder.Serialize(PexAddrs{peers})...)
+	self.sendPexControl(peer, body)
+}
+
+// handlePexControl dispatches a PEX-channel datagram once
+// receiveMessage has stripped its channel tag.
+func (self*UDPTransport) handlePexControl(peer cipher.PubKey, body []byte) {
+	self.lock.Lock()
+	pex := self.pex
+	self.lock.Unlock()
+	if pex == nil || len(body) == 0 {
+		return
+	}
+
+	switch body[0] {
+		case pexMsgRequest:
+			self.sendPexAddrs(peer, pex.book)
+		case pexMsgAddrs: {
+			var v reflect.Value = reflect.New(reflect.TypeOf(PexAddrs{}))
+			_, err := encoder.DeserializeRawToValue(body[1:], v)
+			if err != nil {
+				return
+			}
+			addrs := (v.Elem().Interface()).(PexAddrs)
+			for _, info := range addrs.Peers {
+				pex.book.AddNew(info.PubKey, info.Comm)
+			}
+		}
+	}
+}
+
+func (self*UDPTransport) pexConnectToNewPeers(pex*pexState) {
+	connected := self.connectedPeerKeys()
+	if pex.maxPeers > 0 && len(connected) >= pex.maxPeers {
+		return
+	}
+
+	// maxPeers == 0 means unlimited; ask the book for everything it has
+	// rather than computing a negative want from an unbounded cap.
+	want := math.MaxInt32
+	if pex.maxPeers > 0 {
+		want = pex.maxPeers - len(connected)
+	}
+
+	for _, entry := range pex.book.SampleUntried(want) {
+		if self.ConnectedToPeer(entry.PubKey) {
+			continue
+		}
+		connectInfo, err := json.Marshal(entry.Comm)
+		if err != nil {
+			continue
+		}
+		err = self.ConnectToPeer(entry.PubKey, string(connectInfo))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "PEX auto-connect to %v failed: %v\n", entry.PubKey, err)
+			continue
+		}
+		pex.book.MarkTried(entry.PubKey)
+	}
+}
+
+func (self*UDPTransport) pexAskForAddrs() {
+	connected := self.connectedPeerKeys()
+	rand.Shuffle(len(connected), func(i, j int) { connected[i], connected[j] = connected[j], connected[i] })
+	if len(connected) > pexAskPeerCount {
+		connected = connected[:pexAskPeerCount]
+	}
+	for _, peer := range connected {
+		self.sendPexRequest(peer)
+	}
+}
+
+func (self*UDPTransport) pexLoop() {
+	defer self.closeWait.Done()
+
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case <- ticker.C: {
+				self.lock.Lock()
+				pex := self.pex
+				self.lock.Unlock()
+				if pex == nil {
+					continue
+				}
+				self.pexConnectToNewPeers(pex)
+				self.pexAskForAddrs()
+			}
+			case <- self.closing:
+				return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package mesh
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+// TestPexGossipLearnsNewPeer is a two-instance loopback test for PEX
+// gossip itself: A asks B for addresses, and B's reply must teach A
+// about a peer (C) that only B's book knew of. Before the fix, both
+// the request (handlePexControl's peer argument) and every reply
+// (sendPexControl/sendPexAddrs, routed through sendMessage's
+// safeGetPeer(message.DestPeer)) carried the wrong identity, so
+// gossip never actually reached the other side.
+func TestPexGossipLearnsNewPeer(t *testing.T) {
+	a, b, _, _ := newLoopbackUDPPair(t, 31500)
+	defer a.Close()
+	defer b.Close()
+
+	aBook := NewAddrBook(filepath.Join(t.TempDir(), "a.json"))
+	bBook := NewAddrBook(filepath.Join(t.TempDir(), "b.json"))
+
+	pubC, _ := cipher.GenerateKeyPair()
+	bBook.AddNew(pubC, commFor("10.1.2.3"))
+
+	a.EnablePEX(aBook)
+	b.EnablePEX(bBook)
+
+	a.pexAskForAddrs()
+
+	deadline := time.After(2 * time.Second)
+	for !aBook.Known(pubC) {
+		select {
+		case <-deadline:
+			t.Fatal("timed out waiting for A to learn about C via PEX")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// TestPexConnectToNewPeersUnlimitedDoesNotPanic covers MaxPeers == 0
+// ("unlimited", per UDPConfig's doc comment): pexConnectToNewPeers used
+// to compute pex.maxPeers - len(connected), a negative number once any
+// peer was connected, and pass it straight into SampleUntried's
+// all[:n] slice -- an immediate slice-bounds panic on pexLoop's first
+// tick.
+func TestPexConnectToNewPeersUnlimitedDoesNotPanic(t *testing.T) {
+	a, b, _, _ := newLoopbackUDPPair(t, 31510)
+	defer a.Close()
+	defer b.Close()
+
+	book := NewAddrBook(filepath.Join(t.TempDir(), "unlimited.json"))
+	a.EnablePEX(book) // a.config.MaxPeers is left at its zero value: unlimited
+
+	a.lock.Lock()
+	pex := a.pex
+	a.lock.Unlock()
+
+	a.pexConnectToNewPeers(pex)
+}
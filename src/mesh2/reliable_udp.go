@@ -0,0 +1,425 @@
+package mesh
+
+import(
+	"container/heap"
+	"errors"
+	"reflect"
+	"sync"
+	"time")
+
+import(
+	"github.com/skycoin/encoder"
+	"github.com/skycoin/skycoin/src/cipher")
+
+const (
+	reliableWindowSize = 32		// max unacked messages in flight per peer
+	reliableMaxRetries = 8			// retries before a message is dropped
+	reliableRecvRingSize = 256		// per-peer dedupe ring for received seqs
+	reliableMinTimeout = 100 * time.Millisecond
+	reliableMaxTimeout = 5 * time.Second
+	reliableDefaultTimeout = 300 * time.Millisecond
+	reliableTickInterval = 20 * time.Millisecond
+)
+
+// reliableFrame is the wire format the reliability layer wraps around a
+// caller's TransportMessage contents. Ack frames carry no payload. The
+// sender's identity doesn't need to travel in here: the outer
+// TransportMessage.SrcPeer already carries it.
+type reliableFrame struct {
+	Seq uint32
+	Ack bool
+	Payload []byte
+}
+
+// SendFailure is surfaced on the reliable transport's error channel when
+// a message could not be delivered after reliableMaxRetries retransmits.
+// The send is non-blocking: a failure is discarded if the channel's
+// buffer (ReceiveChannelLength) is full.
+type SendFailure struct {
+	Peer cipher.PubKey
+	Seq uint32
+	Error error
+}
+
+type pendingMessage struct {
+	seq uint32
+	framed TransportMessage
+	retries uint32
+	sentAt time.Time
+	deadline time.Time
+	heapIndex int
+}
+
+type retransmitHeap []*pendingMessage
+
+func (h retransmitHeap) Len() int { return len(h) }
+func (h retransmitHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+func (h retransmitHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].heapIndex = i
+	h[j].heapIndex = j
+}
+func (h *retransmitHeap) Push(x interface{}) {
+	item := x.(*pendingMessage)
+	item.heapIndex = len(*h)
+	*h = append(*h, item)
+}
+func (h *retransmitHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	old[n-1] = nil
+	item.heapIndex = -1
+	*h = old[:n-1]
+	return item
+}
+
+// peerARQState tracks everything the reliability layer needs per peer:
+// the outgoing send window, RTT estimation, and the receive-side
+// dedupe ring.
+type peerARQState struct {
+	lock sync.Mutex
+
+	nextSeq uint32
+	pending map[uint32]*pendingMessage
+	retransmits retransmitHeap
+	window chan struct{}
+
+	haveRTT bool
+	srtt time.Duration
+	rttvar time.Duration
+
+	recvSeqs [reliableRecvRingSize]uint32
+	recvSeen [reliableRecvRingSize]bool
+}
+
+func newPeerARQState() *peerARQState {
+	return &peerARQState{
+		pending: make(map[uint32]*pendingMessage),
+		window: make(chan struct{}, reliableWindowSize),
+	}
+}
+
+// ReliableUDPTransport layers ARQ (sequencing, ACKs, RTT-based
+// retransmit) on top of a plain UDPTransport.
+type ReliableUDPTransport struct {
+	inner *UDPTransport
+
+	lock *sync.Mutex
+	peers map[cipher.PubKey]*peerARQState
+
+	messagesReceived chan TransportMessage
+	sendFailures chan SendFailure
+	closing chan bool
+	closeWait *sync.WaitGroup
+}
+
+// NewReliableUDPTransport opens a UDPTransport and layers the ARQ
+// reliability protocol on top of it.
+func NewReliableUDPTransport(config UDPConfig) (*ReliableUDPTransport, error) {
+	inner, err := NewUDPTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &ReliableUDPTransport{
+		inner,
+		&sync.Mutex{},
+		make(map[cipher.PubKey]*peerARQState),
+		make(chan TransportMessage, config.ReceiveChannelLength),
+		make(chan SendFailure, config.ReceiveChannelLength),
+		make(chan bool, 2),
+		&sync.WaitGroup{},
+	}
+
+	ret.closeWait.Add(2)
+	go ret.receiveLoop()
+	go ret.retransmitLoop()
+
+	return ret, nil
+}
+
+// NewTransport opens a UDPTransport and, if config.Reliable is set,
+// wraps it in the ARQ reliability layer; the result satisfies
+// Transport either way.
+func NewTransport(config UDPConfig) (Transport, error) {
+	if config.Reliable {
+		return NewReliableUDPTransport(config)
+	}
+	return NewUDPTransport(config)
+}
+
+func (self*ReliableUDPTransport) safeGetPeerState(peer cipher.PubKey) (*peerARQState, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	state, found := self.peers[peer]
+	return state, found
+}
+
+func (self*ReliableUDPTransport) ConnectToPeer(peer cipher.PubKey, connectInfo string) error {
+	err := self.inner.ConnectToPeer(peer, connectInfo)
+	if err != nil {
+		return err
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.peers[peer] = newPeerARQState()
+	return nil
+}
+
+func (self*ReliableUDPTransport) DisconnectFromPeer(peer cipher.PubKey) {
+	self.inner.DisconnectFromPeer(peer)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.peers, peer)
+}
+
+func (self*ReliableUDPTransport) ConnectedToPeer(peer cipher.PubKey) bool {
+	return self.inner.ConnectedToPeer(peer)
+}
+
+func (self*ReliableUDPTransport) SetCrypto(crypto interface{}) {
+	self.inner.SetCrypto(crypto)
+}
+
+func (self*ReliableUDPTransport) IsReliable() bool {
+	return true
+}
+
+func (self*ReliableUDPTransport) GetTransportConnectInfo() string {
+	return self.inner.GetTransportConnectInfo()
+}
+
+func (self*ReliableUDPTransport) GetMaximumMessageSizeToPeer(peer cipher.PubKey) uint {
+	max := self.inner.GetMaximumMessageSizeToPeer(peer)
+	overhead := uint(len(encoder.Serialize(reliableFrame{})))
+	if max <= overhead {
+		return 0
+	}
+	return max - overhead
+}
+
+// RetransmitIntervalHint returns a live EWMA-based RTT estimate for the
+// peer: srtt = 7/8*srtt + 1/8*sample, rttvar = 3/4*rttvar +
+// 1/4*|srtt-sample|, timeout = srtt + 4*rttvar, clamped to
+// [reliableMinTimeout, reliableMaxTimeout].
+func (self*ReliableUDPTransport) RetransmitIntervalHint(toPeer cipher.PubKey) uint32 {
+	state, found := self.safeGetPeerState(toPeer)
+	if !found {
+		return uint32(reliableDefaultTimeout / time.Millisecond)
+	}
+
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	if !state.haveRTT {
+		return uint32(reliableDefaultTimeout / time.Millisecond)
+	}
+
+	timeout := state.srtt + 4*state.rttvar
+	if timeout < reliableMinTimeout {
+		timeout = reliableMinTimeout
+	}
+	if timeout > reliableMaxTimeout {
+		timeout = reliableMaxTimeout
+	}
+	return uint32(timeout / time.Millisecond)
+}
+
+func (state*peerARQState) recordSample(sample time.Duration) {
+	if !state.haveRTT {
+		state.srtt = sample
+		state.rttvar = sample / 2
+		state.haveRTT = true
+		return
+	}
+	diff := state.srtt - sample
+	if diff < 0 {
+		diff = -diff
+	}
+	state.rttvar = (state.rttvar*3 + diff) / 4
+	state.srtt = (state.srtt*7 + sample) / 8
+}
+
+func (self*ReliableUDPTransport) retransmitTimeout(state*peerARQState) time.Duration {
+	if !state.haveRTT {
+		return reliableDefaultTimeout
+	}
+	timeout := state.srtt + 4*state.rttvar
+	if timeout < reliableMinTimeout {
+		timeout = reliableMinTimeout
+	}
+	if timeout > reliableMaxTimeout {
+		timeout = reliableMaxTimeout
+	}
+	return timeout
+}
+
+// SendMessage wraps msg in a sequenced reliableFrame, tracks it for
+// retransmit, and blocks if the peer's send window is full.
+func (self*ReliableUDPTransport) SendMessage(msg TransportMessage) error {
+	state, found := self.safeGetPeerState(msg.DestPeer)
+	if !found {
+		return errors.New("SendMessage to unconnected peer")
+	}
+
+	state.window <- struct{}{}
+
+	state.lock.Lock()
+	seq := state.nextSeq
+	state.nextSeq++
+	frame := reliableFrame{seq, false, msg.Contents}
+	framed := TransportMessage{DestPeer: msg.DestPeer, Contents: encoder.Serialize(frame)}
+
+	pending := &pendingMessage{
+		seq,
+		framed,
+		0,
+		time.Now(),
+		time.Now().Add(self.retransmitTimeout(state)),
+		-1,
+	}
+	state.pending[seq] = pending
+	heap.Push(&state.retransmits, pending)
+	state.lock.Unlock()
+
+	return self.inner.SendMessage(framed)
+}
+
+func (self*ReliableUDPTransport) sendAck(peer cipher.PubKey, seq uint32) {
+	frame := reliableFrame{seq, true, nil}
+	framed := TransportMessage{DestPeer: peer, Contents: encoder.Serialize(frame)}
+	self.inner.SendMessage(framed)
+}
+
+func (state*peerARQState) markReceived(seq uint32) (isNew bool) {
+	slot := seq % reliableRecvRingSize
+	if state.recvSeen[slot] && state.recvSeqs[slot] == seq {
+		return false
+	}
+	state.recvSeqs[slot] = seq
+	state.recvSeen[slot] = true
+	return true
+}
+
+func (self*ReliableUDPTransport) handleFrame(raw TransportMessage) {
+	var v reflect.Value = reflect.New(reflect.TypeOf(reliableFrame{}))
+	_, err := encoder.DeserializeRawToValue(raw.Contents, v)
+	if err != nil {
+		return
+	}
+	frame := (v.Elem().Interface()).(reliableFrame)
+
+	state, found := self.safeGetPeerState(raw.SrcPeer)
+	if !found {
+		return
+	}
+
+	if frame.Ack {
+		state.lock.Lock()
+		pending, ok := state.pending[frame.Seq]
+		if ok {
+			delete(state.pending, frame.Seq)
+			if pending.heapIndex >= 0 {
+				heap.Remove(&state.retransmits, pending.heapIndex)
+			}
+			state.recordSample(time.Since(pending.sentAt))
+		}
+		state.lock.Unlock()
+		if ok {
+			<-state.window
+		}
+		return
+	}
+
+	state.lock.Lock()
+	isNew := state.markReceived(frame.Seq)
+	state.lock.Unlock()
+
+	self.sendAck(raw.SrcPeer, frame.Seq)
+
+	if isNew {
+		self.messagesReceived <- TransportMessage{DestPeer: raw.DestPeer, SrcPeer: raw.SrcPeer, Contents: frame.Payload}
+	}
+}
+
+func (self*ReliableUDPTransport) receiveLoop() {
+	defer self.closeWait.Done()
+	for {
+		select {
+			case raw := <- self.inner.GetReceiveChannel(): {
+				self.handleFrame(raw)
+			}
+			case <- self.closing:
+				return
+		}
+	}
+}
+
+func (self*ReliableUDPTransport) retransmitDue(state*peerARQState, now time.Time) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+
+	for len(state.retransmits) > 0 && !state.retransmits[0].deadline.After(now) {
+		pending := state.retransmits[0]
+
+		if pending.retries >= reliableMaxRetries {
+			heap.Pop(&state.retransmits)
+			delete(state.pending, pending.seq)
+			state.lock.Unlock()
+			<-state.window
+			select {
+				case self.sendFailures <- SendFailure{pending.framed.DestPeer, pending.seq, errors.New("message dropped after max retries")}:
+				default:
+			}
+			state.lock.Lock()
+			continue
+		}
+
+		pending.retries++
+		pending.deadline = now.Add(self.retransmitTimeout(state))
+		heap.Fix(&state.retransmits, 0)
+		self.inner.SendMessage(pending.framed)
+	}
+}
+
+func (self*ReliableUDPTransport) retransmitLoop() {
+	defer self.closeWait.Done()
+	ticker := time.NewTicker(reliableTickInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+			case now := <- ticker.C: {
+				self.lock.Lock()
+				states := make([]*peerARQState, 0, len(self.peers))
+				for _, state := range self.peers {
+					states = append(states, state)
+				}
+				self.lock.Unlock()
+
+				for _, state := range states {
+					self.retransmitDue(state, now)
+				}
+			}
+			case <- self.closing:
+				return
+		}
+	}
+}
+
+func (self*ReliableUDPTransport) GetReceiveChannel() chan TransportMessage {
+	return self.messagesReceived
+}
+
+// GetSendFailures returns the channel SendFailures are published on
+// when a message is dropped after exhausting its retries.
+func (self*ReliableUDPTransport) GetSendFailures() chan SendFailure {
+	return self.sendFailures
+}
+
+func (self*ReliableUDPTransport) Close() {
+	self.closing <- true
+	self.closing <- true
+	self.closeWait.Wait()
+	self.inner.Close()
+}
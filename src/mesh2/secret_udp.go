@@ -0,0 +1,508 @@
+package mesh
+
+import(
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	cryptocipher "crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"sync"
+	"time")
+
+import(
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"golang.org/x/crypto/hkdf")
+
+import(
+	"github.com/skycoin/encoder"
+	"github.com/skycoin/skycoin/src/cipher")
+
+const (
+	secretReplayWindowSize = 64		// WireGuard-style sliding replay window, in messages
+	secretRekeyAfterMessages = 1 << 20
+	secretRekeyAfterDuration = 2 * time.Minute
+	secretHandshakeTimeout = 5 * time.Second
+	secretNonceSize = chacha20poly1305.NonceSize
+)
+
+const (
+	secretFrameHandshake byte = iota
+	secretFrameData
+)
+
+// handshakeMessage carries a fresh X25519 ephemeral public key,
+// authenticated by a signature from the sender's long-term skycoin
+// keypair -- an X25519+signature stand-in for a Noise-IK handshake.
+type handshakeMessage struct {
+	StaticPubKey cipher.PubKey
+	EphemeralPubKey [32]byte
+	Signature cipher.Sig
+}
+
+type secretFrame struct {
+	Kind byte
+	Handshake handshakeMessage
+	Counter uint64
+	Ciphertext []byte
+}
+
+// secretReplayWindow rejects datagrams whose counter is a duplicate or
+// too far behind the highest counter seen, WireGuard-style.
+type secretReplayWindow struct {
+	initialized bool
+	highest uint64
+	mask uint64
+}
+
+// check reports whether counter would be accepted (new, or within the
+// window and not already seen) without mutating the window. Callers
+// must authenticate the datagram carrying counter before calling
+// confirm -- mutating the window on unauthenticated data lets a single
+// spoofed packet (valid SrcPeer, forged Counter, garbage ciphertext)
+// poison highest and permanently lock out the real peer's subsequent,
+// now-"too old", messages.
+func (self*secretReplayWindow) check(counter uint64) bool {
+	if !self.initialized {
+		return true
+	}
+
+	if counter > self.highest {
+		return true
+	}
+
+	diff := self.highest - counter
+	if diff >= secretReplayWindowSize {
+		return false
+	}
+	return self.mask & (uint64(1) << diff) == 0
+}
+
+// confirm records counter as seen. Must only be called after the
+// datagram carrying it has passed AEAD authentication; see check.
+func (self*secretReplayWindow) confirm(counter uint64) {
+	if !self.initialized {
+		self.initialized = true
+		self.highest = counter
+		self.mask = 1
+		return
+	}
+
+	if counter > self.highest {
+		shift := counter - self.highest
+		if shift >= secretReplayWindowSize {
+			self.mask = 1
+		} else {
+			self.mask = (self.mask << shift) | 1
+		}
+		self.highest = counter
+		return
+	}
+
+	diff := self.highest - counter
+	self.mask |= uint64(1) << diff
+}
+
+// peerSecretState holds a peer's current send/receive keys plus
+// everything needed to decide when to rekey and to reject replayed or
+// unauthenticated datagrams.
+type peerSecretState struct {
+	lock sync.Mutex
+
+	ready bool
+	// handshakeDone is unbuffered so a send only succeeds while a
+	// goroutine is actually inside handshake() waiting on it -- with a
+	// buffered channel, handleFrame's non-blocking send would silently
+	// accept and shelve the peer's handshakeMessage even when nobody
+	// was listening, so an unsolicited handshake looked "handled" and
+	// was never actually answered.
+	handshakeDone chan handshakeMessage
+
+	sendAEAD cryptocipher.AEAD
+	sendCounter uint64
+
+	recvAEAD cryptocipher.AEAD
+	replayWindow secretReplayWindow
+
+	keyedAt time.Time
+	messagesSent uint64
+}
+
+func newPeerSecretState() *peerSecretState {
+	return &peerSecretState{
+		handshakeDone: make(chan handshakeMessage),
+	}
+}
+
+func (self*peerSecretState) needsRekey() bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if !self.ready {
+		return false
+	}
+	return self.messagesSent >= secretRekeyAfterMessages || time.Since(self.keyedAt) >= secretRekeyAfterDuration
+}
+
+func directionLabels(localEph, remoteEph [32]byte) (sendLabel, recvLabel string) {
+	if bytes.Compare(localEph[:], remoteEph[:]) < 0 {
+		return "mesh-secret-udp:A->B", "mesh-secret-udp:B->A"
+	}
+	return "mesh-secret-udp:B->A", "mesh-secret-udp:A->B"
+}
+
+func deriveAEAD(sharedSecret []byte, label string) (cryptocipher.AEAD, error) {
+	kdf := hkdf.New(sha256.New, sharedSecret, nil, []byte(label))
+	key := make([]byte, chacha20poly1305.KeySize)
+	_, err := io.ReadFull(kdf, key)
+	if err != nil {
+		return nil, err
+	}
+	return chacha20poly1305.New(key)
+}
+
+// SecretUDPTransport layers an authenticated, encrypted, replay-
+// protected datagram framing on top of another Transport: an X25519
+// key exchange per peer (authenticated by the peer's long-term
+// skycoin keypair) derives distinct send/receive ChaCha20-Poly1305
+// keys, and every datagram carries a 64-bit counter checked against a
+// sliding replay window.
+type SecretUDPTransport struct {
+	inner Transport
+	localPubKey cipher.PubKey
+	localSecKey cipher.SecKey
+
+	lock *sync.Mutex
+	peers map[cipher.PubKey]*peerSecretState
+
+	messagesReceived chan TransportMessage
+	closing chan bool
+	closeWait *sync.WaitGroup
+}
+
+// SecretUDPConfig is a UDPConfig plus the local identity keypair the
+// handshake authenticates with.
+type SecretUDPConfig struct {
+	UDPConfig
+	LocalPubKey cipher.PubKey
+	LocalSecKey cipher.SecKey
+}
+
+// NewSecretUDPTransport opens a UDPTransport and layers the
+// authenticated/encrypted handshake protocol on top of it.
+func NewSecretUDPTransport(config SecretUDPConfig) (*SecretUDPTransport, error) {
+	config.UDPConfig.LocalPubKey = config.LocalPubKey
+	inner, err := NewUDPTransport(config.UDPConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &SecretUDPTransport{
+		inner,
+		config.LocalPubKey,
+		config.LocalSecKey,
+		&sync.Mutex{},
+		make(map[cipher.PubKey]*peerSecretState),
+		make(chan TransportMessage, config.ReceiveChannelLength),
+		make(chan bool, 1),
+		&sync.WaitGroup{},
+	}
+
+	ret.closeWait.Add(1)
+	go ret.receiveLoop()
+
+	return ret, nil
+}
+
+func (self*SecretUDPTransport) safeGetPeer(peer cipher.PubKey) (*peerSecretState, bool) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	state, found := self.peers[peer]
+	return state, found
+}
+
+func (self*SecretUDPTransport) newEphemeralKeypair() (priv [32]byte, pub [32]byte, err error) {
+	_, err = io.ReadFull(rand.Reader, priv[:])
+	if err != nil {
+		return
+	}
+	curve25519.ScalarBaseMult(&pub, &priv)
+	return
+}
+
+// buildHandshakeMessage generates a fresh ephemeral keypair and the
+// signed handshakeMessage that announces it, used by both the
+// initiating and the responding side of a handshake.
+func (self*SecretUDPTransport) buildHandshakeMessage() (priv [32]byte, pub [32]byte, mine handshakeMessage, err error) {
+	priv, pub, err = self.newEphemeralKeypair()
+	if err != nil {
+		return
+	}
+	sig := cipher.SignHash(cipher.SumSHA256(pub[:]), self.localSecKey)
+	mine = handshakeMessage{self.localPubKey, pub, sig}
+	return
+}
+
+// installSession verifies theirs, derives the send/recv AEADs from
+// our ephemeral priv/pub and their ephemeral key, and installs the
+// result into state. Shared by the initiating side (after waiting on
+// state.handshakeDone) and the responding side (which already has
+// theirs from the frame that triggered it).
+func (self*SecretUDPTransport) installSession(state*peerSecretState, priv [32]byte, pub [32]byte, theirs handshakeMessage, peer cipher.PubKey) error {
+	if theirs.StaticPubKey != peer {
+		return errors.New("Handshake static key did not match expected peer")
+	}
+	verifyErr := cipher.VerifySignature(theirs.StaticPubKey, theirs.Signature, cipher.SumSHA256(theirs.EphemeralPubKey[:]))
+	if verifyErr != nil {
+		return verifyErr
+	}
+
+	var sharedSecret [32]byte
+	curve25519.ScalarMult(&sharedSecret, &priv, &theirs.EphemeralPubKey)
+
+	sendLabel, recvLabel := directionLabels(pub, theirs.EphemeralPubKey)
+	sendAEAD, err := deriveAEAD(sharedSecret[:], sendLabel)
+	if err != nil {
+		return err
+	}
+	recvAEAD, err := deriveAEAD(sharedSecret[:], recvLabel)
+	if err != nil {
+		return err
+	}
+
+	state.lock.Lock()
+	state.sendAEAD = sendAEAD
+	state.sendCounter = 0
+	state.recvAEAD = recvAEAD
+	state.replayWindow = secretReplayWindow{}
+	state.keyedAt = time.Now()
+	state.messagesSent = 0
+	state.ready = true
+	state.lock.Unlock()
+
+	return nil
+}
+
+// handshake runs the initiating side of a (re-)key exchange for peer:
+// send our handshakeMessage, wait for theirs, then install the
+// resulting send/recv AEADs into state.
+func (self*SecretUDPTransport) handshake(peer cipher.PubKey, state*peerSecretState) error {
+	priv, pub, mine, err := self.buildHandshakeMessage()
+	if err != nil {
+		return err
+	}
+
+	frame := secretFrame{secretFrameHandshake, mine, 0, nil}
+	framed := TransportMessage{DestPeer: peer, Contents: encoder.Serialize(frame)}
+	sendErr := self.inner.SendMessage(framed)
+	if sendErr != nil {
+		return sendErr
+	}
+
+	var theirs handshakeMessage
+	select {
+		case theirs = <- state.handshakeDone:
+		case <- time.After(secretHandshakeTimeout):
+			return errors.New("Handshake with peer timed out")
+	}
+
+	return self.installSession(state, priv, pub, theirs, peer)
+}
+
+// respondToHandshake answers an unsolicited handshakeMessage from
+// peer (nobody on this side was waiting in handshake() for it): reply
+// with our own handshakeMessage and install the session from theirs,
+// rather than silently dropping the frame. Without this, a rekey the
+// peer initiates unilaterally (see SendMessage's needsRekey check)
+// always times out on their side and is never retried cleanly.
+func (self*SecretUDPTransport) respondToHandshake(peer cipher.PubKey, state*peerSecretState, theirs handshakeMessage) {
+	priv, pub, mine, err := self.buildHandshakeMessage()
+	if err != nil {
+		return
+	}
+
+	frame := secretFrame{secretFrameHandshake, mine, 0, nil}
+	framed := TransportMessage{DestPeer: peer, Contents: encoder.Serialize(frame)}
+	if err := self.inner.SendMessage(framed); err != nil {
+		return
+	}
+
+	self.installSession(state, priv, pub, theirs, peer)
+}
+
+func (self*SecretUDPTransport) ConnectToPeer(peer cipher.PubKey, connectInfo string) error {
+	err := self.inner.ConnectToPeer(peer, connectInfo)
+	if err != nil {
+		return err
+	}
+
+	state := newPeerSecretState()
+	self.lock.Lock()
+	self.peers[peer] = state
+	self.lock.Unlock()
+
+	handshakeErr := self.handshake(peer, state)
+	if handshakeErr != nil {
+		self.lock.Lock()
+		delete(self.peers, peer)
+		self.lock.Unlock()
+		self.inner.DisconnectFromPeer(peer)
+		return handshakeErr
+	}
+	return nil
+}
+
+func (self*SecretUDPTransport) DisconnectFromPeer(peer cipher.PubKey) {
+	self.inner.DisconnectFromPeer(peer)
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	delete(self.peers, peer)
+}
+
+func (self*SecretUDPTransport) ConnectedToPeer(peer cipher.PubKey) bool {
+	return self.inner.ConnectedToPeer(peer)
+}
+
+func (self*SecretUDPTransport) SetCrypto(crypto interface{}) {
+	// SecretUDPTransport supplies its own authenticated encryption;
+	// the bare TransportCrypto hook on the inner transport is unused.
+}
+
+func (self*SecretUDPTransport) IsReliable() bool {
+	return self.inner.IsReliable()
+}
+
+func (self*SecretUDPTransport) RetransmitIntervalHint(toPeer cipher.PubKey) uint32 {
+	return self.inner.RetransmitIntervalHint(toPeer)
+}
+
+func (self*SecretUDPTransport) GetTransportConnectInfo() string {
+	return self.inner.GetTransportConnectInfo()
+}
+
+func (self*SecretUDPTransport) GetMaximumMessageSizeToPeer(peer cipher.PubKey) uint {
+	max := self.inner.GetMaximumMessageSizeToPeer(peer)
+	overhead := uint(8 + chacha20poly1305.Overhead + len(encoder.Serialize(secretFrame{})))
+	if max <= overhead {
+		return 0
+	}
+	return max - overhead
+}
+
+func (self*SecretUDPTransport) SendMessage(msg TransportMessage) error {
+	state, found := self.safeGetPeer(msg.DestPeer)
+	if !found {
+		return errors.New("SendMessage to unconnected peer")
+	}
+
+	state.lock.Lock()
+	if !state.ready {
+		state.lock.Unlock()
+		return errors.New("Handshake with peer not yet complete")
+	}
+	counter := state.sendCounter
+	state.sendCounter++
+	state.messagesSent++
+	aead := state.sendAEAD
+	state.lock.Unlock()
+
+	nonce := make([]byte, secretNonceSize)
+	binary.BigEndian.PutUint64(nonce[secretNonceSize-8:], counter)
+	ciphertext := aead.Seal(nil, nonce, msg.Contents, nil)
+
+	frame := secretFrame{secretFrameData, handshakeMessage{}, counter, ciphertext}
+	framed := TransportMessage{DestPeer: msg.DestPeer, Contents: encoder.Serialize(frame)}
+
+	err := self.inner.SendMessage(framed)
+	if err != nil {
+		return err
+	}
+
+	if state.needsRekey() {
+		go self.handshake(msg.DestPeer, state)
+	}
+	return nil
+}
+
+func (self*SecretUDPTransport) handleFrame(raw TransportMessage) {
+	var v reflect.Value = reflect.New(reflect.TypeOf(secretFrame{}))
+	_, err := encoder.DeserializeRawToValue(raw.Contents, v)
+	if err != nil {
+		return
+	}
+	frame := (v.Elem().Interface()).(secretFrame)
+
+	state, found := self.safeGetPeer(raw.SrcPeer)
+	if !found {
+		return
+	}
+
+	if frame.Kind == secretFrameHandshake {
+		select {
+			case state.handshakeDone <- frame.Handshake:
+				// An initiator (ConnectToPeer, or our own rekey) is
+				// waiting on this peer's reply; let it finish there.
+			default:
+				// Unsolicited: either first contact from a peer that
+				// dialed us, or a rekey the peer initiated on its own.
+				// Nobody is waiting on handshakeDone, so answer it
+				// ourselves instead of dropping it -- otherwise the
+				// peer's handshake()/rekey blocks for
+				// secretHandshakeTimeout and then fails, and since a
+				// failed rekey never clears needsRekey(), every later
+				// SendMessage spawns another doomed handshake goroutine.
+				go self.respondToHandshake(raw.SrcPeer, state, frame.Handshake)
+		}
+		return
+	}
+
+	state.lock.Lock()
+	if !state.ready {
+		state.lock.Unlock()
+		return
+	}
+	if !state.replayWindow.check(frame.Counter) {
+		state.lock.Unlock()
+		return
+	}
+	aead := state.recvAEAD
+	state.lock.Unlock()
+
+	nonce := make([]byte, secretNonceSize)
+	binary.BigEndian.PutUint64(nonce[secretNonceSize-8:], frame.Counter)
+	plaintext, err := aead.Open(nil, nonce, frame.Ciphertext, nil)
+	if err != nil {
+		return
+	}
+
+	state.lock.Lock()
+	state.replayWindow.confirm(frame.Counter)
+	state.lock.Unlock()
+
+	self.messagesReceived <- TransportMessage{DestPeer: raw.DestPeer, SrcPeer: raw.SrcPeer, Contents: plaintext}
+}
+
+func (self*SecretUDPTransport) receiveLoop() {
+	defer self.closeWait.Done()
+	for {
+		select {
+			case raw := <- self.inner.GetReceiveChannel(): {
+				self.handleFrame(raw)
+			}
+			case <- self.closing:
+				return
+		}
+	}
+}
+
+func (self*SecretUDPTransport) GetReceiveChannel() chan TransportMessage {
+	return self.messagesReceived
+}
+
+func (self*SecretUDPTransport) Close() {
+	self.closing <- true
+	self.closeWait.Wait()
+	self.inner.Close()
+}
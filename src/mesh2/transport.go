@@ -0,0 +1,61 @@
+package mesh
+
+import(
+	"github.com/skycoin/skycoin/src/cipher")
+
+// TransportMessage is the unit of data exchanged between nodes over a
+// Transport. DestPeer identifies which of the transport's connected
+// peers the message is addressed to; SrcPeer is stamped on automatically
+// at send time with the local node's own identity (TransportConfig.LocalPubKey),
+// so that on receipt it tells a wrapper or caller which peer the message
+// actually came from -- DestPeer alone can't, since it's whatever value
+// the sender used to address its own connectedPeers map, which is
+// meaningless once it arrives at the receiver.
+type TransportMessage struct {
+	DestPeer cipher.PubKey
+	SrcPeer cipher.PubKey
+	Contents []byte
+}
+
+// TransportConfig holds the fields common to every Transport
+// implementation.
+type TransportConfig struct {
+	SendChannelLength uint32
+	ReceiveChannelLength uint32
+	LocalPubKey cipher.PubKey	// This node's identity; stamped onto outgoing messages as SrcPeer
+	Reliable bool		// If true, NewTransport wraps the transport in ARQ
+	MaxFramedMessageSize uint32	// Advertised cap once fragmented; 0 defaults to 16MB
+}
+
+// TransportCrypto encrypts and decrypts the datagrams a Transport sends
+// and receives, operating on a fixed-size buffer matching the
+// Transport's datagram length.
+type TransportCrypto interface {
+	Encrypt(buffer []byte) []byte
+	Decrypt(buffer []byte) []byte
+}
+
+// Transport is the interface a node uses to talk to peers without
+// caring whether the underlying link is raw UDP, reliable UDP, etc.
+type Transport interface {
+	SetCrypto(crypto interface{})
+	IsReliable() bool
+	ConnectedToPeer(peer cipher.PubKey) bool
+	RetransmitIntervalHint(toPeer cipher.PubKey) uint32
+	ConnectToPeer(peer cipher.PubKey, connectInfo string) error
+	DisconnectFromPeer(peer cipher.PubKey)
+	GetMaximumMessageSizeToPeer(peer cipher.PubKey) uint
+	SendMessage(msg TransportMessage) error
+	GetReceiveChannel() chan TransportMessage
+	GetTransportConnectInfo() string
+	Close()
+}
+
+// Serializer is reserved for future message multiplexing; it currently
+// wraps the stateless github.com/skycoin/encoder helpers.
+type Serializer struct {
+}
+
+func NewSerializer() *Serializer {
+	return &Serializer{}
+}
@@ -17,23 +17,26 @@ import(
 	"github.com/skycoin/encoder"
     "github.com/skycoin/skycoin/src/cipher")
 
-import(
-    "github.com/ccding/go-stun/stun")
-
 type UDPConfig struct {
 	TransportConfig
 	DatagramLength	uint16
 	LocalAddress string 	// "" for default
 
 	NumListenPorts uint16
-	ListenPortMin uint16		// If 0, STUN is used
-	ExternalAddress string  	// External address to use if STUN is not
+	ListenPortMin uint16		// If 0, NAT traversal is used
+	ExternalAddress string  	// External address to use if NAT traversal is not
 	StunEndpoints []string		// STUN servers to try for NAT traversal
+
+	NATMethods []string			// Tried in order; defaults to {"stun"} if empty. "upnp" and "natpmp" are also available
+	PortMapLeaseSeconds uint32	// UPnP/NAT-PMP lease duration; refreshed at half this interval. Defaults to 3600
+
+	MaxPeers uint32				// Cap PEX auto-connects at, once EnablePEX is called. 0 means unlimited
 }
 
 type ListenPort struct {
 	externalHost net.UDPAddr
 	conn *net.UDPConn
+	natTraversal NATTraversal		// nil unless the port's external address came from NAT traversal (ListenPortMin == 0); released on Close()
 }
 
 type UDPCommConfig struct {
@@ -53,7 +56,8 @@ type UDPTransport struct {
 
 	// Thread protected variables
 	lock *sync.Mutex
-	connectedPeers map[cipher.PubKey]UDPCommConfig
+	connectedPeers map[cipher.PubKey]*peerConnection
+	pex *pexState		// nil unless EnablePEX has been called
 }
 
 func OpenUDPPort(port_index uint16, config UDPConfig, wg *sync.WaitGroup, 
@@ -86,45 +90,25 @@ func OpenUDPPort(port_index uint16, config UDPConfig, wg *sync.WaitGroup,
     	return
     }
 
+	var natTraversal NATTraversal
 	if config.ListenPortMin == 0 {
-		if (config.StunEndpoints == nil) || len(config.StunEndpoints) == 0 {
-			errorChan <- errors.New("No local port or STUN endpoints specified in config: no way to receive datagrams")
-	    	return
-		}
-		var stun_success bool = false
-		for _, addr := range config.StunEndpoints {
-			stunClient := stun.NewClientWithConnection(udpConn)
-			stunClient.SetServerAddr(addr)
-
-			_, host, error := stunClient.Discover()
-			if error != nil {
-				fmt.Fprintf(os.Stderr, "STUN Error for Endpoint '%v': %v\n", addr, error)
-				continue
-			} else {
-				externalHostStr = host.TransportAddr()
-			    externalHost, resolvErr = net.ResolveUDPAddr("udp", externalHostStr)
-			    if resolvErr != nil {
-			    	errorChan <- resolvErr
-			    	return
-			    }
-				stun_success = true
-				break
-			}
-		}
-		if !stun_success {
-			errorChan <- errors.New("All STUN requests failed")
-    		return
+		discovered, method, discoverErr := discoverExternalAddr(config, udpConn, port)
+		if discoverErr != nil {
+			errorChan <- discoverErr
+			return
 		}
+		externalHost = &discovered
+		natTraversal = method
 	}
 
-	// STUN library sets the deadlines
+	// STUN (and some NAT-PMP/UPnP clients) sets the deadlines
     udpConn.SetDeadline(time.Time{})
     udpConn.SetReadDeadline(time.Time{})
     udpConn.SetWriteDeadline(time.Time{})
-	portChan <- ListenPort{*externalHost, udpConn}
+	portChan <- ListenPort{*externalHost, udpConn, natTraversal}
 }
 
-func (self*UDPTransport) receiveMessage(buffer []byte) {
+func (self*UDPTransport) receiveMessage(buffer []byte, portIndex int, fromAddr net.UDPAddr) {
 	if self.crypto != nil {
 		buffer = self.crypto.Decrypt(buffer)
 	}
@@ -140,6 +124,30 @@ func (self*UDPTransport) receiveMessage(buffer []byte) {
     	return
     }
     msg := m.(TransportMessage)
+
+    // Roam: a valid datagram from a known peer always updates that
+    // peer's endpoint to the address/socket it was just seen on.
+    peerConn, found := self.safeGetPeer(msg.SrcPeer)
+    if found {
+    	peerConn.endpoint.SetDst(fromAddr)
+    	peerConn.endpoint.SetSrc(portIndex)
+    }
+
+    self.lock.Lock()
+    pex := self.pex
+    self.lock.Unlock()
+    if pex != nil {
+    	if len(msg.Contents) == 0 {
+    		return
+    	}
+    	channel := msg.Contents[0]
+    	msg.Contents = msg.Contents[1:]
+    	if channel == pexChanControl {
+    		self.handlePexControl(msg.SrcPeer, msg.Contents)
+    		return
+    	}
+    }
+
     self.messagesReceived <- msg
 }
 
@@ -152,23 +160,24 @@ func strongUint() uint32 {
 	return binary.LittleEndian.Uint32(socket_i_b)
 }
 
-func (self*UDPTransport) safeGetPeerComm(peer cipher.PubKey) (*UDPCommConfig, bool) {
+func (self*UDPTransport) safeGetPeer(peer cipher.PubKey) (*peerConnection, bool) {
 	self.lock.Lock()
 	defer self.lock.Unlock()
-	peerComm, foundPeer := self.connectedPeers[peer]
+	peerConn, foundPeer := self.connectedPeers[peer]
 	if !foundPeer {
 		return nil, false
 	}
-	return &peerComm, true
+	return peerConn, true
 }
 
 func (self*UDPTransport) sendMessage(message TransportMessage) {
 	// Find pubkey
-	peerComm, found := self.safeGetPeerComm(message.DestPeer)
+	peerConn, found := self.safeGetPeer(message.DestPeer)
 	if !found {
 		fmt.Fprintf(os.Stderr, "Dropping message that is to an unknown peer: %v\n", message.DestPeer)
 		return
 	}
+	peerComm := peerConn.comm
 
 	// Add pubkey to datagram
 	serialized := encoder.Serialize(message)
@@ -187,13 +196,22 @@ func (self*UDPTransport) sendMessage(message TransportMessage) {
 		datagramBuffer = self.crypto.Encrypt(datagramBuffer)
 	}
 
-	// Choose a socket randomly
-	fromSocketIndex := strongUint() % (uint32)(len(self.listenPorts))
+	// Prefer the cached source socket that last heard from this peer,
+	// falling back to a random pick when there's no cache entry yet.
+	fromSocketIndex, haveSrc := peerConn.endpoint.Src()
+	if !haveSrc {
+		fromSocketIndex = int(strongUint() % (uint32)(len(self.listenPorts)))
+	}
 	conn := self.listenPorts[fromSocketIndex].conn
 
-	// Send datagram
-	toAddrIndex := strongUint() % (uint32)(len(peerComm.ExternalHosts))
-	toAddr := peerComm.ExternalHosts[toAddrIndex]
+	// Prefer the peer's last-seen destination, falling back to a
+	// random pick among its advertised hosts when there's none cached.
+	toAddr, haveDst := peerConn.endpoint.Dst()
+	if !haveDst {
+		toAddrIndex := strongUint() % (uint32)(len(peerComm.ExternalHosts))
+		toAddr = peerComm.ExternalHosts[toAddrIndex]
+		peerConn.endpoint.SetDst(toAddr)
+	}
 
 	n, err := conn.WriteToUDP(datagramBuffer, &toAddr)
 	if err != nil {
@@ -206,21 +224,21 @@ func (self*UDPTransport) sendMessage(message TransportMessage) {
 	}
 }
 
-func (self*UDPTransport) listenTo(port ListenPort) {
+func (self*UDPTransport) listenTo(portIndex int, port ListenPort) {
 	self.closeWait.Add(1)
 	defer self.closeWait.Done()
 
 	buffer := make([]byte, self.config.DatagramLength)
 
 	for len(self.closing) == 0 {
-		n, _, err := port.conn.ReadFromUDP(buffer)
+		n, fromAddr, err := port.conn.ReadFromUDP(buffer)
 		if err != nil {
 			if len(self.closing) == 0 {
 				fmt.Fprintf(os.Stderr, "Error on ReadFromUDP for %v: %v\n", port.externalHost, err)
 			}
 			break
 		}
-		self.receiveMessage(buffer[:n])
+		self.receiveMessage(buffer[:n], portIndex, *fromAddr)
 	}
 }
 
@@ -280,11 +298,12 @@ func NewUDPTransport(config UDPConfig) (*UDPTransport, error) {
 		nil,	// No crypto by default
 		NewSerializer(),
 		&sync.Mutex{},
-		make(map[cipher.PubKey]UDPCommConfig),
+		make(map[cipher.PubKey]*peerConnection),
+		nil,	// No PEX unless EnablePEX is called
 	}
 
-	for _, port := range ret.listenPorts {
-		go ret.listenTo(port)
+	for portIndex, port := range ret.listenPorts {
+		go ret.listenTo(portIndex, port)
 	}
 
 	go ret.sendLoop()
@@ -293,6 +312,12 @@ func NewUDPTransport(config UDPConfig) (*UDPTransport, error) {
 }
 
 func (self*UDPTransport) Close() {
+	for _, port := range self.listenPorts {
+		if port.natTraversal != nil {
+			port.natTraversal.Release()
+		}
+	}
+
 	self.closeWait.Add(len(self.listenPorts))
 	for i := 0;i < 10*len(self.listenPorts);i++ {
 		self.closing <- true
@@ -337,7 +362,7 @@ func (self*UDPTransport) IsReliable() bool {
 }
 
 func (self*UDPTransport) ConnectedToPeer(peer cipher.PubKey) bool {
-	_, found := self.safeGetPeerComm(peer)
+	_, found := self.safeGetPeer(peer)
 	return found
 }
 
@@ -358,7 +383,7 @@ func (self*UDPTransport) ConnectToPeer(peer cipher.PubKey, connectInfo string) e
 	if connected {
 		return errors.New(fmt.Sprintf("Already connected to peer %v", peer))
 	}
-	self.connectedPeers[peer] = config
+	self.connectedPeers[peer] = &peerConnection{config, newUDPEndpoint()}
 	return nil
 }
 
@@ -368,14 +393,30 @@ func (self*UDPTransport) DisconnectFromPeer(peer cipher.PubKey) {
 	delete(self.connectedPeers, peer)
 }
 
+// ClearSrc forces sendMessage to reselect a local socket for peer on
+// its next send, e.g. after a network change invalidates the cache.
+func (self*UDPTransport) ClearSrc(peer cipher.PubKey) {
+	peerConn, found := self.safeGetPeer(peer)
+	if !found {
+		return
+	}
+	peerConn.endpoint.ClearSrc()
+}
+
 func (self*UDPTransport) GetMaximumMessageSizeToPeer(peer cipher.PubKey) uint {
-	commConfig, found := self.safeGetPeerComm(peer)
+	peerConn, found := self.safeGetPeer(peer)
 	if !found {
 		fmt.Fprintf(os.Stderr, "Unknown peer passed to GetMaximumMessageSizeToPeer: %v\n", peer)
 		return 0
 	}
-	serialized := encoder.Serialize(TransportMessage{cipher.PubKey{}, []byte{}})
-	ret := int(commConfig.DatagramLength) - len(serialized)
+	serialized := encoder.Serialize(TransportMessage{DestPeer: cipher.PubKey{}, Contents: []byte{}})
+	ret := int(peerConn.comm.DatagramLength) - len(serialized)
+	self.lock.Lock()
+	pex := self.pex
+	self.lock.Unlock()
+	if pex != nil {
+		ret-- // PEX channel tag
+	}
 	if ret <= 0 {
 		return 0
 	}
@@ -383,6 +424,13 @@ func (self*UDPTransport) GetMaximumMessageSizeToPeer(peer cipher.PubKey) uint {
 }
 
 func (self*UDPTransport) SendMessage(msg TransportMessage) error {
+	msg.SrcPeer = self.config.LocalPubKey
+	self.lock.Lock()
+	pex := self.pex
+	self.lock.Unlock()
+	if pex != nil {
+		msg.Contents = append([]byte{pexChanData}, msg.Contents...)
+	}
 	self.messagesToSend <- msg
 	return nil
 }
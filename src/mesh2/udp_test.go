@@ -0,0 +1,84 @@
+package mesh
+
+import (
+	"testing"
+	"time"
+
+	"github.com/skycoin/skycoin/src/cipher"
+)
+
+func newLoopbackUDPPair(t *testing.T, basePort uint16) (a, b *UDPTransport, pubA, pubB cipher.PubKey) {
+	cfgA, cfgB, pubA, pubB, _, _ := newLoopbackUDPConfigs(basePort, 1024)
+
+	var err error
+	a, err = NewUDPTransport(cfgA)
+	if err != nil {
+		t.Fatalf("NewUDPTransport(A): %v", err)
+	}
+	b, err = NewUDPTransport(cfgB)
+	if err != nil {
+		a.Close()
+		t.Fatalf("NewUDPTransport(B): %v", err)
+	}
+
+	connectLoopbackPeers(t, a, b, pubA, pubB)
+	return a, b, pubA, pubB
+}
+
+// TestUDPLoopbackDelivery is the base-layer two-instance loopback test:
+// a real payload must arrive, carrying the sender's identity as
+// SrcPeer rather than whatever value the sender used to address its
+// own peer map.
+func TestUDPLoopbackDelivery(t *testing.T) {
+	a, b, pubA, pubB := newLoopbackUDPPair(t, 31100)
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.SendMessage(TransportMessage{DestPeer: pubB, Contents: []byte("roam me")}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	select {
+	case msg := <-b.GetReceiveChannel():
+		if string(msg.Contents) != "roam me" {
+			t.Fatalf("got %q", msg.Contents)
+		}
+		if msg.SrcPeer != pubA {
+			t.Fatalf("SrcPeer = %v, want %v", msg.SrcPeer, pubA)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for message")
+	}
+}
+
+// TestUDPRoamingCachesEndpoint asserts the actual point of this
+// request: once B has seen a valid datagram from A, it caches A's
+// endpoint instead of picking a path at random on every send. This
+// lookup was keyed by the wrong peer identity before the fix, so
+// SetDst/SetSrc never fired for any two distinct, real peers.
+func TestUDPRoamingCachesEndpoint(t *testing.T) {
+	a, b, pubA, pubB := newLoopbackUDPPair(t, 31110)
+	defer a.Close()
+	defer b.Close()
+
+	if err := a.SendMessage(TransportMessage{DestPeer: pubB, Contents: []byte("hello")}); err != nil {
+		t.Fatalf("SendMessage: %v", err)
+	}
+
+	select {
+	case <-b.GetReceiveChannel():
+	case <-time.After(2 * time.Second):
+		t.Fatal("timed out waiting for B to receive the message")
+	}
+
+	peerConn, found := b.safeGetPeer(pubA)
+	if !found {
+		t.Fatal("B has no peer state for A")
+	}
+	if _, haveDst := peerConn.endpoint.Dst(); !haveDst {
+		t.Fatal("B's endpoint for A never cached a destination address")
+	}
+	if _, haveSrc := peerConn.endpoint.Src(); !haveSrc {
+		t.Fatal("B's endpoint for A never cached a source socket")
+	}
+}